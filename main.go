@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/das7pad/pre-compress/pkg/pre-compress"
@@ -31,8 +33,49 @@ import (
 func main() {
 	rawMTime := flag.String("m-time", time.Time{}.Format(time.RFC3339), "m-time for all files")
 	concurrency := flag.Int("concurrency", runtime.NumCPU(), "concurrency")
+	formats := flag.String(
+		"formats", precompress.DefaultFormats,
+		"comma-separated output formats to produce (gzip,br,zstd)",
+	)
+	parallelFileThreshold := flag.Int64(
+		"parallel-file-threshold", precompress.DefaultParallelFileThreshold,
+		"switch gzip to block-parallel compression above this source file size in bytes (0 disables it)",
+	)
+	parallelFileBlockSize := flag.Int(
+		"parallel-file-block-size", precompress.DefaultParallelFileBlockSize,
+		"pgzip block size in bytes once -parallel-file-threshold is exceeded",
+	)
+	parallelFileBlocks := flag.Int(
+		"parallel-file-blocks", runtime.GOMAXPROCS(0),
+		"number of pgzip blocks compressed concurrently once -parallel-file-threshold is exceeded",
+	)
+	zopfliMode := flag.Bool(
+		"zopfli", false,
+		"use Zopfli instead of gzip for the \"gzip\" format: ~100x slower, a few percent smaller",
+	)
+	skipMIME := flag.String(
+		"skip-mime", "",
+		"comma-separated MIME glob patterns to skip without compressing (e.g. image/*,font/woff2)",
+	)
+	skipExtensions := flag.String(
+		"skip-extensions", "",
+		"comma-separated file extensions to skip, resolved to MIME types and added to -skip-mime",
+	)
+	manifestPath := flag.String(
+		"manifest", "",
+		"write a JSON manifest of every source file considered to this path",
+	)
+	manifestVerifyPath := flag.String(
+		"manifest-verify", "",
+		"re-hash the compressed outputs recorded in this manifest and exit non-zero on drift, without compressing",
+	)
 	flag.Parse()
 
+	if *manifestVerifyPath != "" {
+		verify(*manifestVerifyPath)
+		return
+	}
+
 	mTime, err := time.Parse(time.RFC3339, *rawMTime)
 	if err != nil {
 		panic(fmt.Errorf("invalid m-time: %w", err))
@@ -41,11 +84,110 @@ func main() {
 	if err != nil {
 		panic(fmt.Errorf("get cwd: %w", err))
 	}
+	encs, err := precompress.ParseFormats(*formats)
+	if err != nil {
+		panic(fmt.Errorf("invalid formats: %w", err))
+	}
+	if *zopfliMode {
+		encs = precompress.ApplyZopfli(encs)
+	}
+	var skipPatterns []string
+	if *skipMIME != "" {
+		skipPatterns = append(skipPatterns, strings.Split(*skipMIME, ",")...)
+	}
+	if *skipExtensions != "" {
+		resolved, err := precompress.ResolveSkipExtensions(strings.Split(*skipExtensions, ","))
+		if err != nil {
+			panic(fmt.Errorf("invalid skip-extensions: %w", err))
+		}
+		skipPatterns = append(skipPatterns, resolved...)
+	}
+	o := &precompress.Options{
+		Encoders:              encs,
+		ParallelFileThreshold: *parallelFileThreshold,
+		ParallelFileBlockSize: *parallelFileBlockSize,
+		ParallelFileBlocks:    *parallelFileBlocks,
+		SkipMIME:              skipPatterns,
+	}
+
+	var entries []precompress.ManifestEntry
+	var manifestCh chan precompress.ManifestEntry
+	var collectWG sync.WaitGroup
+	if *manifestPath != "" {
+		manifestCh = make(chan precompress.ManifestEntry, *concurrency*10)
+		o.Manifest = manifestCh
+		collectWG.Add(1)
+		go func() {
+			defer collectWG.Done()
+			for entry := range manifestCh {
+				entries = append(entries, entry)
+			}
+		}()
+	}
 
-	n, err := precompress.Recursive(root, mTime, *concurrency, flag.Args())
-	fmt.Printf("%d pre-compressed\n", n)
+	summary, err := precompress.Recursive(root, mTime, *concurrency, flag.Args(), o)
+	fmt.Printf("%d pre-compressed\n", summary.Compressed)
+	if summary.SkippedMIME > 0 {
+		fmt.Printf("%d skipped (incompressible mime type)\n", summary.SkippedMIME)
+	}
+
+	if *manifestPath != "" {
+		close(manifestCh)
+		collectWG.Wait()
+
+		out, writeErr := os.Create(*manifestPath)
+		if writeErr != nil {
+			panic(fmt.Errorf("create manifest: %w", writeErr))
+		}
+		writeErr = precompress.WriteManifest(out, entries)
+		closeErr := out.Close()
+		if writeErr != nil {
+			panic(fmt.Errorf("write manifest: %w", writeErr))
+		}
+		if closeErr != nil {
+			panic(fmt.Errorf("write manifest: %w", closeErr))
+		}
+	}
 
 	if err != nil {
 		panic(fmt.Errorf("failed: %w", err))
 	}
 }
+
+// verify re-hashes every compressed output recorded in the manifest at
+// manifestPath against the local filesystem and exits non-zero if any of
+// them has drifted, so CI can catch a compressed asset going stale without
+// re-running the full compression pass.
+func verify(manifestPath string) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		panic(fmt.Errorf("open manifest: %w", err))
+	}
+	entries, err := precompress.ReadManifest(f)
+	_ = f.Close()
+	if err != nil {
+		panic(fmt.Errorf("read manifest: %w", err))
+	}
+
+	drifted, err := precompress.VerifyManifest(precompress.OsFs, entries)
+	if err != nil {
+		panic(fmt.Errorf("verify manifest: %w", err))
+	}
+	if len(drifted) == 0 {
+		fmt.Printf("%d outputs verified, no drift\n", countOutputs(entries))
+		return
+	}
+	for _, path := range drifted {
+		fmt.Printf("drifted: %s\n", path)
+	}
+	fmt.Printf("%d of %d outputs drifted\n", len(drifted), countOutputs(entries))
+	os.Exit(1)
+}
+
+func countOutputs(entries []precompress.ManifestEntry) int {
+	n := 0
+	for _, entry := range entries {
+		n += len(entry.Outputs)
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Encoder produces a single pre-compressed sibling (e.g. the ".gz" in
+// "app.js.gz") for a source file. Implementations wrap a format-specific
+// compressor and are safe to reuse across files and goroutines.
+type Encoder interface {
+	// Ext returns the file extension for this format's output, including
+	// the leading dot.
+	Ext() string
+	// NewWriter wraps w with a writer that compresses at BestLevel.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// BestLevel returns the highest compression level this encoder
+	// supports.
+	BestLevel() int
+}
+
+type gzipEncoder struct{}
+
+func (gzipEncoder) Ext() string    { return ".gz" }
+func (gzipEncoder) BestLevel() int { return gzip.BestCompression }
+
+func (e gzipEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, e.BestLevel())
+}
+
+// newWriterForSize switches gzip output to pgzip's block-parallel
+// implementation once size exceeds o.ParallelFileThreshold, which produces
+// byte-for-byte gzip-compatible output while spreading one file's
+// compression across multiple goroutines.
+func (e gzipEncoder) newWriterForSize(w io.Writer, size int64, o *Options) (io.WriteCloser, error) {
+	if o == nil || o.ParallelFileThreshold <= 0 || size < o.ParallelFileThreshold {
+		return e.NewWriter(w)
+	}
+
+	o.parallelSem <- struct{}{}
+	release := func() { <-o.parallelSem }
+
+	pz, err := pgzip.NewWriterLevel(w, e.BestLevel())
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err = pz.SetConcurrency(o.ParallelFileBlockSize, o.ParallelFileBlocks); err != nil {
+		release()
+		return nil, err
+	}
+	return &pgzipWriteCloser{Writer: pz, release: release}, nil
+}
+
+// pgzipWriteCloser releases the semaphore token backing a block-parallel
+// gzip compression once the writer is closed, successfully or not.
+type pgzipWriteCloser struct {
+	*pgzip.Writer
+	release func()
+	closed  bool
+}
+
+func (w *pgzipWriteCloser) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.release()
+	return w.Writer.Close()
+}
+
+// sizeAwareEncoder is implemented by Encoders whose writer can switch to a
+// block-parallel implementation for inputs large enough to benefit from it.
+type sizeAwareEncoder interface {
+	newWriterForSize(w io.Writer, size int64, o *Options) (io.WriteCloser, error)
+}
+
+type brotliEncoder struct{}
+
+func (brotliEncoder) Ext() string    { return ".br" }
+func (brotliEncoder) BestLevel() int { return brotli.BestCompression }
+
+func (e brotliEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return brotli.NewWriterLevel(w, e.BestLevel()), nil
+}
+
+type zstdEncoder struct{}
+
+func (zstdEncoder) Ext() string    { return ".zst" }
+func (zstdEncoder) BestLevel() int { return int(zstd.SpeedBestCompression) }
+
+func (e zstdEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(
+		w, zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+	)
+}
+
+// encoders maps the names accepted by the `-formats` flag to the Encoder
+// implementing them.
+var encoders = map[string]Encoder{
+	"gzip": gzipEncoder{},
+	"br":   brotliEncoder{},
+	"zstd": zstdEncoder{},
+}
+
+// DefaultFormats is the `-formats` value used when the flag is left unset,
+// matching the gzip-only behavior of earlier versions.
+const DefaultFormats = "gzip"
+
+// ParseFormats turns a comma-separated `-formats` flag value (e.g.
+// "gzip,br,zstd") into the Encoders to run, in the order given. Duplicate
+// names are rejected, as is an empty or unknown name.
+func ParseFormats(s string) ([]Encoder, error) {
+	names := strings.Split(s, ",")
+	out := make([]Encoder, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		enc, ok := encoders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown format: %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate format: %q", name)
+		}
+		seen[name] = true
+		out = append(out, enc)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no formats given")
+	}
+	return out, nil
+}
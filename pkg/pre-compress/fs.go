@@ -0,0 +1,134 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// File is the subset of *os.File (and afero.File) IfSmallerBuffer needs to
+// read a source file.
+type File interface {
+	io.Reader
+	io.Closer
+}
+
+// FS abstracts the filesystem calls Recursive needs, so a run can target
+// anything afero.Fs can wrap: the local disk, an in-memory filesystem for
+// tests, a chrooted view for CI sandboxes, or an S3/GCS-backed bucket to
+// compress straight onto before deploy.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// OsFs is the default FS, backed directly by the local filesystem.
+var OsFs FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) Open(name string) (File, error) { return os.Open(name) }
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		if infos[i], err = entry.Info(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// aferoFS adapts an afero.Fs to FS.
+type aferoFS struct {
+	fs afero.Fs
+}
+
+// NewAferoFS wraps fs as a FS. The rename-for-atomicity dance and mtime
+// pinning Recursive relies on are load-bearing, so fs must support Rename
+// and Chtimes; rather than fail confusingly mid-run, NewAferoFS checks both
+// up front against a throwaway probe file and rejects fs if either is
+// unsupported.
+func NewAferoFS(fs afero.Fs) (FS, error) {
+	if err := probeRenameChtimes(fs); err != nil {
+		return nil, err
+	}
+	return aferoFS{fs: fs}, nil
+}
+
+func probeRenameChtimes(fs afero.Fs) error {
+	const probe = ".pre-compress-fs-probe"
+	f, err := fs.Create(probe)
+	if err != nil {
+		return fmt.Errorf("probe filesystem %q: create: %w", fs.Name(), err)
+	}
+	_ = f.Close()
+	defer func() { _ = fs.Remove(probe) }()
+
+	if err = fs.Chtimes(probe, time.Now(), time.Now()); err != nil {
+		return fmt.Errorf("filesystem %q does not support Chtimes: %w", fs.Name(), err)
+	}
+	renamed := probe + ".renamed"
+	if err = fs.Rename(probe, renamed); err != nil {
+		return fmt.Errorf("filesystem %q does not support Rename: %w", fs.Name(), err)
+	}
+	_ = fs.Remove(renamed)
+	return nil
+}
+
+func (a aferoFS) Stat(name string) (os.FileInfo, error) { return a.fs.Stat(name) }
+
+func (a aferoFS) Open(name string) (File, error) { return a.fs.Open(name) }
+
+func (a aferoFS) ReadDir(name string) ([]os.FileInfo, error) { return afero.ReadDir(a.fs, name) }
+
+func (a aferoFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return afero.WriteFile(a.fs, name, data, perm)
+}
+
+func (a aferoFS) Rename(oldname, newname string) error { return a.fs.Rename(oldname, newname) }
+
+func (a aferoFS) Chtimes(name string, atime, mtime time.Time) error {
+	return a.fs.Chtimes(name, atime, mtime)
+}
@@ -0,0 +1,111 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Reason codes recorded on a ManifestEntry that wasn't compressed.
+const (
+	ReasonAlreadyCompressed  = "already-compressed"
+	ReasonIgnoredByRegex     = "ignored-by-regex"
+	ReasonIncompressibleMIME = "incompressible-mime"
+	ReasonNotSmaller         = "not-smaller"
+	ReasonError              = "error"
+)
+
+// ManifestEntry records what Recursive did for one source file, for
+// -manifest output. Reason is empty when at least one format in Outputs
+// was written.
+type ManifestEntry struct {
+	Path         string           `json:"path"`
+	OriginalSize int64            `json:"originalSize"`
+	ModTime      time.Time        `json:"modTime"`
+	SHA256       string           `json:"sha256,omitempty"`
+	Outputs      []ManifestOutput `json:"outputs,omitempty"`
+	Reason       string           `json:"reason,omitempty"`
+}
+
+// ManifestOutput records one format's compressed output for a
+// ManifestEntry.
+type ManifestOutput struct {
+	Ext            string  `json:"ext"`
+	CompressedSize int64   `json:"compressedSize"`
+	Ratio          float64 `json:"ratio"`
+	SHA256         string  `json:"sha256"`
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteManifest writes entries to w as deterministically sorted JSON, so
+// two runs over an unchanged tree produce a byte-identical manifest.
+func WriteManifest(w io.Writer, entries []ManifestEntry) error {
+	sorted := make([]ManifestEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sorted)
+}
+
+// ReadManifest reads back a manifest written by WriteManifest.
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// VerifyManifest re-hashes every compressed output recorded in entries
+// against fs and returns the paths whose hash no longer matches, so a
+// build can detect drift between a manifest and what's actually on disk.
+func VerifyManifest(fs FS, entries []ManifestEntry) ([]string, error) {
+	var drifted []string
+	for _, entry := range entries {
+		for _, out := range entry.Outputs {
+			path := entry.Path + out.Ext
+			f, err := fs.Open(path)
+			if err != nil {
+				drifted = append(drifted, path)
+				continue
+			}
+			data, err := io.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %w", path, err)
+			}
+			if sha256Hex(data) != out.SHA256 {
+				drifted = append(drifted, path)
+			}
+		}
+	}
+	return drifted, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	fs := memFS(t)
+	appJS := []byte("compressed app.js bytes")
+	styleCSS := []byte("compressed style.css bytes")
+	if err := fs.WriteFile("/site/app.js.gz", appJS, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := fs.WriteFile("/site/style.css.gz", styleCSS, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []ManifestEntry{
+		{
+			Path:         "/site/style.css",
+			OriginalSize: 40,
+			ModTime:      mtime,
+			SHA256:       sha256Hex([]byte("style.css")),
+			Outputs: []ManifestOutput{
+				{Ext: ".gz", CompressedSize: int64(len(styleCSS)), Ratio: 0.7, SHA256: sha256Hex(styleCSS)},
+			},
+		},
+		{
+			Path:         "/site/app.js",
+			OriginalSize: 30,
+			ModTime:      mtime,
+			SHA256:       sha256Hex([]byte("app.js")),
+			Outputs: []ManifestOutput{
+				{Ext: ".gz", CompressedSize: int64(len(appJS)), Ratio: 0.8, SHA256: sha256Hex(appJS)},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, entries); err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+
+	got, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	want := []ManifestEntry{entries[1], entries[0]} // WriteManifest sorts by Path.
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadManifest round trip = %+v, want %+v", got, want)
+	}
+
+	drifted, err := VerifyManifest(fs, got)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(drifted) != 0 {
+		t.Fatalf("VerifyManifest on untouched outputs reported drift: %v", drifted)
+	}
+}
+
+func TestVerifyManifestDetectsDrift(t *testing.T) {
+	fs := memFS(t)
+	original := []byte("compressed app.js bytes")
+	if err := fs.WriteFile("/site/app.js.gz", original, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	entries := []ManifestEntry{
+		{
+			Path: "/site/app.js",
+			Outputs: []ManifestOutput{
+				{Ext: ".gz", CompressedSize: int64(len(original)), SHA256: sha256Hex(original)},
+			},
+		},
+	}
+
+	if drifted, err := VerifyManifest(fs, entries); err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	} else if len(drifted) != 0 {
+		t.Fatalf("VerifyManifest on untouched output reported drift: %v", drifted)
+	}
+
+	if err := fs.WriteFile("/site/app.js.gz", []byte("tampered bytes"), 0o644); err != nil {
+		t.Fatalf("WriteFile (corrupt): %v", err)
+	}
+	drifted, err := VerifyManifest(fs, entries)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(drifted) != 1 || drifted[0] != "/site/app.js.gz" {
+		t.Fatalf("VerifyManifest drift = %v, want [/site/app.js.gz]", drifted)
+	}
+}
+
+func TestVerifyManifestDetectsMissingOutput(t *testing.T) {
+	fs := memFS(t)
+	entries := []ManifestEntry{
+		{
+			Path: "/site/gone.js",
+			Outputs: []ManifestOutput{
+				{Ext: ".gz", CompressedSize: 5, SHA256: sha256Hex([]byte("hello"))},
+			},
+		},
+	}
+
+	drifted, err := VerifyManifest(fs, entries)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(drifted) != 1 || drifted[0] != "/site/gone.js.gz" {
+		t.Fatalf("VerifyManifest drift = %v, want [/site/gone.js.gz]", drifted)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// sniffSize is how many leading bytes of a file we inspect to guess its
+// content type, matching the window net/http.DetectContentType expects.
+const sniffSize = 512
+
+// magicNumbers covers a few common, already-entropy-coded formats that
+// net/http.DetectContentType doesn't recognize, checked before falling
+// back to it.
+var magicNumbers = []struct {
+	mime   string
+	prefix []byte
+}{
+	{"font/woff2", []byte("wOF2")},
+	{"font/woff", []byte("wOFF")},
+	{"application/wasm", []byte("\x00asm")},
+	{"application/zstd", []byte("\x28\xB5\x2F\xFD")},
+	{"application/x-7z-compressed", []byte("7z\xBC\xAF\x27\x1C")},
+	// net/http.DetectContentType already recognizes gzip, but reports it as
+	// "application/x-gzip", not the "application/gzip" one would guess; a
+	// dedicated entry keeps DefaultSkipExtensions's ".gz" mapping obvious
+	// and independent of that quirk.
+	{"application/gzip", []byte("\x1F\x8B")},
+}
+
+// DetectContentType sniffs a file's content type from its leading bytes.
+func DetectContentType(sniffed []byte) string {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(sniffed, m.prefix) {
+			return m.mime
+		}
+	}
+	return http.DetectContentType(sniffed)
+}
+
+// matchMIME reports whether mime matches any of the glob patterns (e.g.
+// "image/*", "font/woff2"), using path.Match semantics.
+func matchMIME(patterns []string, mime string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSkipExtensions seeds -skip-extensions with already-compressed or
+// entropy-coded formats that are identified more reliably by their
+// extension than by sniffing a handful of bytes.
+var DefaultSkipExtensions = map[string]string{
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".woff2": "font/woff2",
+	".zip":   "application/zip",
+	".7z":    "application/x-7z-compressed",
+	".zst":   "application/zstd",
+	".gz":    "application/gzip",
+	".wasm":  "application/wasm",
+}
+
+// ResolveSkipExtensions turns a list of file extensions into the MIME
+// glob patterns for -skip-mime.
+func ResolveSkipExtensions(extensions []string) ([]string, error) {
+	out := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		mime, ok := DefaultSkipExtensions[ext]
+		if !ok {
+			return nil, fmt.Errorf("unknown skip-extension: %q", ext)
+		}
+		out = append(out, mime)
+	}
+	return out, nil
+}
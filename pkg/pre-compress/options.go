@@ -0,0 +1,82 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+// Options configures a compression run: which formats to produce, and, for
+// large inputs, how far gzip is allowed to fan out across CPUs.
+type Options struct {
+	// Encoders are the formats produced for each source file.
+	Encoders []Encoder
+
+	// ParallelFileThreshold is the source file size, in bytes, above which
+	// gzip output switches from a single goroutine to block-parallel
+	// compression via pgzip. Zero disables block-parallel compression.
+	ParallelFileThreshold int64
+	// ParallelFileBlockSize is the pgzip block size used once
+	// ParallelFileThreshold is exceeded.
+	ParallelFileBlockSize int
+	// ParallelFileBlocks is the number of pgzip blocks compressed
+	// concurrently once ParallelFileThreshold is exceeded.
+	ParallelFileBlocks int
+
+	// SkipMIME holds glob patterns (e.g. "image/*", "font/woff2") matched
+	// against each file's sniffed content type. A match skips compression
+	// entirely, without reading the rest of the file. Empty disables
+	// sniffing.
+	SkipMIME []string
+
+	// Manifest, if non-nil, receives one ManifestEntry per source file
+	// considered, in no particular order. Recursive never closes Manifest;
+	// the caller must drain it concurrently (it's sized to back-pressure
+	// workers, not to buffer the whole tree) and close it only after
+	// Recursive has returned.
+	Manifest chan<- ManifestEntry
+
+	// parallelSem bounds how many files can be in block-parallel
+	// compression at once, so a tree of huge files can't spin up far more
+	// compression goroutines than -concurrency allows.
+	parallelSem chan struct{}
+}
+
+const (
+	// DefaultParallelFileThreshold is the default -parallel-file-threshold,
+	// matching common block-parallel thresholds.
+	DefaultParallelFileThreshold = 6 * 1024 * 1024
+	// DefaultParallelFileBlockSize is the default -parallel-file-block-size.
+	DefaultParallelFileBlockSize = 1024 * 1024
+)
+
+// init lazily allocates the semaphore backing ParallelFileThreshold. Every
+// worker is free to call newWriterForSize concurrently, and each call that
+// crosses the threshold spins up its own pgzip listener goroutine plus
+// ParallelFileBlocks block-compression goroutines, so sizing the semaphore
+// to concurrency alone never blocks: all concurrency workers can acquire a
+// token at once, each bringing 1+ParallelFileBlocks extra goroutines along.
+// Size it instead so that concurrency many in-flight pgzip invocations
+// stay bounded by concurrency in total, by admitting only
+// concurrency/(1+ParallelFileBlocks) of them at a time.
+func (o *Options) init(concurrency int) {
+	if o.ParallelFileThreshold > 0 {
+		n := concurrency / (1 + o.ParallelFileBlocks)
+		if n < 1 {
+			n = 1
+		}
+		o.parallelSem = make(chan struct{}, n)
+	}
+}
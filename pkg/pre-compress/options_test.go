@@ -0,0 +1,140 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestOptionsInit_SemaphoreSize pins the parallelSem sizing formula: it must
+// scale down with ParallelFileBlocks so that concurrency many held tokens
+// never imply more than ~concurrency total pgzip goroutines. A regression to
+// the earlier `make(chan struct{}, concurrency)` sizing would pass the
+// concurrency=1 case below but fail every other one.
+func TestOptionsInit_SemaphoreSize(t *testing.T) {
+	cases := []struct {
+		concurrency int
+		blocks      int
+		want        int
+	}{
+		{concurrency: 1, blocks: 0, want: 1},
+		{concurrency: 4, blocks: 0, want: 4},
+		{concurrency: 4, blocks: 3, want: 1},
+		{concurrency: 4, blocks: 8, want: 1},
+		{concurrency: 16, blocks: 3, want: 4},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("concurrency=%d/blocks=%d", c.concurrency, c.blocks), func(t *testing.T) {
+			o := &Options{ParallelFileThreshold: 1, ParallelFileBlocks: c.blocks}
+			o.init(c.concurrency)
+			if got := cap(o.parallelSem); got != c.want {
+				t.Fatalf("cap(parallelSem) = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+// countingGzipEncoder wraps gzipEncoder to track how many newWriterForSize
+// calls are concurrently in flight, i.e. how many pgzip invocations (each
+// bringing its own listener goroutine plus ParallelFileBlocks block
+// goroutines) are alive at once.
+type countingGzipEncoder struct {
+	gzipEncoder
+	active  int64
+	maxSeen int64
+}
+
+func (c *countingGzipEncoder) newWriterForSize(w io.Writer, size int64, o *Options) (io.WriteCloser, error) {
+	wc, err := c.gzipEncoder.newWriterForSize(w, size, o)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt64(&c.active, 1)
+	for {
+		max := atomic.LoadInt64(&c.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt64(&c.maxSeen, max, n) {
+			break
+		}
+	}
+	// Hold the token briefly so overlapping acquisitions actually overlap
+	// instead of the test racing through files one at a time.
+	time.Sleep(time.Millisecond)
+	return &countingWriteCloser{WriteCloser: wc, c: c}, nil
+}
+
+type countingWriteCloser struct {
+	io.WriteCloser
+	c      *countingGzipEncoder
+	closed bool
+}
+
+func (cc *countingWriteCloser) Close() error {
+	err := cc.WriteCloser.Close()
+	if !cc.closed {
+		cc.closed = true
+		atomic.AddInt64(&cc.c.active, -1)
+	}
+	return err
+}
+
+// TestRecursiveFS_ParallelFileSemaphoreBound drives several large files
+// through RecursiveFS with a low -parallel-file-threshold and a worker pool
+// wide enough to try them all at once, then checks that the number of
+// concurrently in-flight pgzip invocations never exceeded the semaphore's
+// capacity. This is the regression this package needed after 25561d9: with
+// the earlier (no-op) sizing, maxSeen could climb to concurrency instead of
+// staying at the scaled-down bound.
+func TestRecursiveFS_ParallelFileSemaphoreBound(t *testing.T) {
+	fs := memFS(t)
+	content := []byte(strings.Repeat("large file payload ", 4096)) // ~80 KiB
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("/site/big-%d.bin", i)
+		if err := fs.WriteFile(name, content, 0o644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", name, err)
+		}
+	}
+
+	enc := &countingGzipEncoder{}
+	o := &Options{
+		Encoders:              []Encoder{enc},
+		ParallelFileThreshold: 1,
+		ParallelFileBlockSize: 64 * 1024,
+		ParallelFileBlocks:    8,
+	}
+	const concurrency = 4
+	if _, err := RecursiveFS(fs, "/site", time.Now(), concurrency, nil, o); err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+
+	wantCap := 1 // concurrency=4, blocks=8 -> 4/(1+8) rounds down to 0, floored to 1.
+	if got := cap(o.parallelSem); got != wantCap {
+		t.Fatalf("cap(parallelSem) = %d, want %d", got, wantCap)
+	}
+	if enc.maxSeen > int64(wantCap) {
+		t.Fatalf("observed %d concurrent pgzip invocations, want <= %d (semaphore cap)", enc.maxSeen, wantCap)
+	}
+	if enc.maxSeen < 1 {
+		t.Fatalf("observed 0 concurrent pgzip invocations, test didn't exercise the block-parallel path")
+	}
+}
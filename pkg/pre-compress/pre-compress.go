@@ -20,77 +20,168 @@ package precompress
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
-	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-func IfSmaller(path string, m time.Time) (bool, error) {
-	return IfSmallerBuffer(path, m, &bytes.Buffer{}, nil)
+func IfSmaller(fs FS, path string, m time.Time, o *Options) (bool, bool, error) {
+	outs := make([]*bytes.Buffer, len(o.Encoders))
+	for i := range outs {
+		outs[i] = &bytes.Buffer{}
+	}
+	entry, err := IfSmallerBuffer(fs, path, m, o, outs, nil)
+	if err != nil {
+		return false, false, err
+	}
+	return entry.Reason == "", entry.Reason == ReasonIncompressibleMIME, nil
 }
 
-func IfSmallerBuffer(path string, m time.Time, out *bytes.Buffer, buf []byte) (bool, error) {
-	s, err := os.Stat(path)
+// IfSmallerBuffer compresses path with every Encoder in o.Encoders in a
+// single pass and keeps the outputs that end up smaller than the source
+// file, writing each one next to path under its own Ext(). outs must have
+// one reusable buffer per entry in o.Encoders. The returned ManifestEntry
+// always describes path; its Reason is empty if at least one format was
+// written, and its SHA256/ManifestOutput.SHA256 fields are only populated
+// when o.Manifest is non-nil, since hashing is wasted work otherwise.
+func IfSmallerBuffer(fs FS, path string, m time.Time, o *Options, outs []*bytes.Buffer, buf []byte) (*ManifestEntry, error) {
+	s, err := fs.Stat(path)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	entry := &ManifestEntry{Path: path, OriginalSize: s.Size(), ModTime: m}
 	if !s.ModTime().Equal(m) {
-		if err = os.Chtimes(path, m, m); err != nil {
-			return false, err
+		if err = fs.Chtimes(path, m, m); err != nil {
+			return nil, err
 		}
 	}
-	f, err := os.Open(path)
+	f, err := fs.Open(path)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer func() { _ = f.Close() }()
 
-	out.Reset()
-	out.Grow(int(s.Size()))
-
-	w := limitedWriter{buf: out, n: int(s.Size())}
-	z, err := gzip.NewWriterLevel(&w, gzip.BestCompression)
-	if err != nil {
-		return false, err
+	var hasher hash.Hash
+	if o.Manifest != nil {
+		hasher = sha256.New()
 	}
-	defer func() { _ = z.Close() }()
 
-	n, err := io.CopyBuffer(z, f, buf)
-	if err != nil {
-		if errors.Is(err, errSizeThresholdExceeded) {
-			return false, nil
+	var body io.Reader = f
+	if len(o.SkipMIME) > 0 {
+		sniffed, err := sniff(f, buf)
+		if err != nil {
+			return nil, err
+		}
+		if matchMIME(o.SkipMIME, DetectContentType(sniffed)) {
+			entry.Reason = ReasonIncompressibleMIME
+			return entry, nil
+		}
+		if hasher != nil {
+			body = io.TeeReader(io.MultiReader(bytes.NewReader(sniffed), f), hasher)
+		} else {
+			body = io.MultiReader(bytes.NewReader(sniffed), f)
 		}
-		return false, err
+	} else if hasher != nil {
+		body = io.TeeReader(f, hasher)
 	}
-	if err = z.Close(); err != nil {
-		if errors.Is(err, errSizeThresholdExceeded) {
-			return false, nil
+
+	sinks := make([]*formatSink, len(o.Encoders))
+	for i, enc := range o.Encoders {
+		out := outs[i]
+		out.Reset()
+		out.Grow(int(s.Size()))
+
+		w := &limitedWriter{buf: out, n: int(s.Size())}
+		var z io.WriteCloser
+		if sa, ok := enc.(sizeAwareEncoder); ok {
+			z, err = sa.newWriterForSize(w, s.Size(), o)
+		} else {
+			z, err = enc.NewWriter(w)
 		}
-		return false, err
+		if err != nil {
+			return nil, err
+		}
+		sinks[i] = &formatSink{enc: enc, closer: z, out: out}
 	}
+	defer func() {
+		for _, sink := range sinks {
+			_ = sink.Close()
+		}
+	}()
 
-	if int64(out.Len()) >= n {
-		return false, nil
+	n, err := io.CopyBuffer(&fanOutWriter{sinks: sinks}, body, buf)
+	if err != nil {
+		if !errors.Is(err, errSizeThresholdExceeded) {
+			return nil, err
+		}
+	}
+	if hasher != nil {
+		entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
 	}
 
-	tmp := path + ".gz~"
-	if err = os.WriteFile(tmp, out.Bytes(), s.Mode().Perm()); err != nil {
-		return false, err
+	for _, sink := range sinks {
+		if sink.aborted {
+			continue
+		}
+		if err = sink.Close(); err != nil {
+			if errors.Is(err, errSizeThresholdExceeded) {
+				continue
+			}
+			return nil, err
+		}
+		if int64(sink.out.Len()) >= n {
+			continue
+		}
+
+		tmp := path + sink.enc.Ext() + "~"
+		if err = fs.WriteFile(tmp, sink.out.Bytes(), s.Mode().Perm()); err != nil {
+			return nil, err
+		}
+		if err = fs.Chtimes(tmp, m, m); err != nil {
+			return nil, err
+		}
+		out := ManifestOutput{
+			Ext:            sink.enc.Ext(),
+			CompressedSize: int64(sink.out.Len()),
+			Ratio:          float64(sink.out.Len()) / float64(entry.OriginalSize),
+		}
+		if hasher != nil {
+			out.SHA256 = sha256Hex(sink.out.Bytes())
+		}
+		if err = fs.Rename(tmp, path+sink.enc.Ext()); err != nil {
+			return nil, err
+		}
+		entry.Outputs = append(entry.Outputs, out)
+	}
+	if len(entry.Outputs) == 0 {
+		entry.Reason = ReasonNotSmaller
 	}
-	if err = os.Chtimes(tmp, m, m); err != nil {
-		return false, err
+	return entry, nil
+}
+
+// sniff reads up to sniffSize leading bytes of f for content-type
+// detection, reusing buf as scratch space when it's large enough instead
+// of allocating a dedicated sniff buffer. The returned slice is an
+// independent copy, safe to read after buf is reused for the real copy.
+func sniff(f File, buf []byte) ([]byte, error) {
+	scratch := buf
+	if len(scratch) < sniffSize {
+		scratch = make([]byte, sniffSize)
 	}
-	if err = os.Rename(tmp, path+".gz"); err != nil {
-		return false, err
+	n, err := io.ReadFull(f, scratch[:sniffSize])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
 	}
-	return true, nil
+	return bytes.Clone(scratch[:n]), nil
 }
 
 var errSizeThresholdExceeded = errors.New("size threshold exceeded")
@@ -109,85 +200,201 @@ func (l *limitedWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func worker(root string, work <-chan string, m time.Time, ignoreRegex *regexp.Regexp) (int64, error) {
-	n := int64(0)
-	out := bytes.Buffer{}
+// formatSink pairs an Encoder's writer with the buffer it writes into and
+// tracks whether it has already given up on this file.
+type formatSink struct {
+	enc     Encoder
+	closer  io.WriteCloser
+	out     *bytes.Buffer
+	aborted bool
+	closed  bool
+}
+
+// Close closes the underlying writer at most once, so the best-effort
+// cleanup deferred in IfSmallerBuffer can't double-close a sink that was
+// already closed on the success path.
+func (s *formatSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.closer.Close()
+}
+
+// fanOutWriter feeds every chunk read from the source file to all live
+// sinks, so the file is only read once regardless of how many formats are
+// configured. A sink that exceeds its size threshold is marked aborted and
+// skipped for the rest of the file; once every sink has aborted, Write
+// reports errSizeThresholdExceeded so the caller can stop reading early.
+type fanOutWriter struct {
+	sinks []*formatSink
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for _, sink := range f.sinks {
+		if sink.aborted {
+			continue
+		}
+		if _, err := sink.closer.Write(p); err != nil {
+			if errors.Is(err, errSizeThresholdExceeded) {
+				sink.aborted = true
+				continue
+			}
+			return 0, err
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errSizeThresholdExceeded
+	}
+	return len(p), nil
+}
+
+func worker(fs FS, root string, work <-chan string, m time.Time, ignoreRegex *regexp.Regexp, o *Options) (Summary, error) {
+	var s Summary
+	outs := make([]*bytes.Buffer, len(o.Encoders))
+	for i := range outs {
+		outs[i] = &bytes.Buffer{}
+	}
 	buf := make([]byte, 32*1024)
-	for s := range work {
-		if ignoreRegex.MatchString(s) {
+	for name := range work {
+		path := filepath.Join(root, name)
+		if ignoreRegex.MatchString(name) {
+			if o.Manifest != nil {
+				o.Manifest <- ManifestEntry{Path: path, Reason: ReasonIgnoredByRegex}
+			}
 			continue
 		}
-		path := filepath.Join(root, s)
-		changed, err := IfSmallerBuffer(path, m, &out, buf)
+		entry, err := IfSmallerBuffer(fs, path, m, o, outs, buf)
 		if err != nil {
-			return n, err
+			if o.Manifest != nil {
+				o.Manifest <- ManifestEntry{Path: path, Reason: ReasonError}
+			}
+			return s, err
+		}
+		switch entry.Reason {
+		case ReasonIncompressibleMIME:
+			s.SkippedMIME++
+		case "":
+			s.Compressed++
 		}
-		if changed {
-			n++
+		if o.Manifest != nil {
+			o.Manifest <- *entry
 		}
 	}
-	return n, nil
+	return s, nil
 }
 
-func recurse(root string, prefix string, work chan<- string, ignore *regexp.Regexp) error {
-	dirs, err := os.ReadDir(filepath.Join(root, prefix))
+// isEncoderOutput reports whether name carries the extension of one of encs,
+// i.e. it is itself a pre-compressed sibling rather than a source file.
+func isEncoderOutput(name string, encs []Encoder) bool {
+	for _, enc := range encs {
+		if strings.HasSuffix(name, enc.Ext()) {
+			return true
+		}
+	}
+	return false
+}
+
+func recurse(
+	fs FS, root string, prefix string, work chan<- string, ignore *regexp.Regexp, encs []Encoder,
+	manifest chan<- ManifestEntry,
+) error {
+	dirs, err := fs.ReadDir(filepath.Join(root, prefix))
 	if err != nil {
 		return err
 	}
 	for i := 0; i < len(dirs); i++ {
 		d := dirs[i]
 		path := filepath.Join(prefix, d.Name())
-		if d.Type().IsDir() {
+		if d.IsDir() {
 			if ignore.MatchString(path) {
 				continue
 			}
-			if err = recurse(root, path, work, ignore); err != nil {
+			if err = recurse(fs, root, path, work, ignore, encs, manifest); err != nil {
 				return err
 			}
-		} else if d.Type().IsRegular() {
-			if strings.HasSuffix(d.Name(), ".gz") {
+		} else if d.Mode().IsRegular() {
+			if isEncoderOutput(d.Name(), encs) {
 				continue
 			}
-			needle := d.Name() + ".gz"
-			found := false
-			for j := i + 1; j < len(dirs); j++ {
-				if dirs[j].Name() == needle {
-					found = true
-					break
-				}
-				if dirs[j].Name() > needle {
+			missing := false
+			for _, enc := range encs {
+				needle := d.Name() + enc.Ext()
+				j := sort.Search(len(dirs), func(j int) bool {
+					return dirs[j].Name() >= needle
+				})
+				if j >= len(dirs) || dirs[j].Name() != needle {
+					missing = true
 					break
 				}
 			}
-			if !found {
+			if missing {
 				work <- path
+			} else if manifest != nil {
+				manifest <- ManifestEntry{
+					Path:         filepath.Join(root, path),
+					OriginalSize: d.Size(),
+					ModTime:      d.ModTime(),
+					Reason:       ReasonAlreadyCompressed,
+				}
 			}
 		}
 	}
 	return nil
 }
 
-func Recursive(root string, m time.Time, concurrency int, ignorePattern []string) (int64, error) {
+// Summary reports what a Recursive (or RecursiveFS) run did across every
+// source file it considered.
+type Summary struct {
+	// Compressed is the number of files for which at least one format's
+	// output was written.
+	Compressed int64
+	// SkippedMIME is the number of files skipped outright because their
+	// sniffed content type matched Options.SkipMIME.
+	SkippedMIME int64
+}
+
+func (s *Summary) add(o Summary) {
+	s.Compressed += o.Compressed
+	s.SkippedMIME += o.SkippedMIME
+}
+
+// Recursive walks root on the local filesystem and pre-compresses every
+// file beneath it that isn't matched by ignorePattern. It's a thin wrapper
+// around RecursiveFS(OsFs, ...), kept for back-compat.
+func Recursive(root string, m time.Time, concurrency int, ignorePattern []string, o *Options) (Summary, error) {
+	return RecursiveFS(OsFs, root, m, concurrency, ignorePattern, o)
+}
+
+// RecursiveFS is Recursive against an arbitrary FS backend, e.g. an
+// in-memory filesystem for tests or an S3/GCS-backed one via NewAferoFS.
+func RecursiveFS(fs FS, root string, m time.Time, concurrency int, ignorePattern []string, o *Options) (Summary, error) {
 	var ignore *regexp.Regexp
 	{
 		var err error
 		ignore, err = regexp.Compile("^" + strings.Join(ignorePattern, "|") + "$")
 		if err != nil {
-			return 0, err
+			return Summary{}, err
 		}
 	}
+	o.init(concurrency)
 
 	work := make(chan string, concurrency*10)
 	firstErr := atomic.Pointer[error]{}
-	total := atomic.Int64{}
+	total := Summary{}
+	totalMu := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			n, err := worker(root, work, m, ignore)
-			total.Add(n)
+			s, err := worker(fs, root, work, m, ignore, o)
+			totalMu.Lock()
+			total.add(s)
+			totalMu.Unlock()
 			if err != nil {
 				firstErr.CompareAndSwap(nil, &err)
 			}
@@ -197,7 +404,7 @@ func Recursive(root string, m time.Time, concurrency int, ignorePattern []string
 		}()
 	}
 
-	err := recurse(root, "", work, ignore)
+	err := recurse(fs, root, "", work, ignore, o.Encoders, o.Manifest)
 	close(work)
 
 	wg.Wait()
@@ -206,5 +413,5 @@ func Recursive(root string, m time.Time, concurrency int, ignorePattern []string
 			err = *p
 		}
 	}
-	return total.Load(), err
+	return total, err
 }
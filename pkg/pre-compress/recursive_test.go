@@ -0,0 +1,161 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+func memFS(t *testing.T) FS {
+	t.Helper()
+	fs, err := NewAferoFS(afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("NewAferoFS: %v", err)
+	}
+	return fs
+}
+
+func TestRecursiveFS_MemMapFs(t *testing.T) {
+	fs := memFS(t)
+	content := []byte(strings.Repeat("hello pre-compress world ", 200))
+	if err := fs.WriteFile("/site/app.js", content, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	o := &Options{Encoders: []Encoder{gzipEncoder{}}}
+	summary, err := RecursiveFS(fs, "/site", time.Now(), 2, nil, o)
+	if err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+	if summary.Compressed != 1 {
+		t.Fatalf("Compressed = %d, want 1", summary.Compressed)
+	}
+
+	f, err := fs.Open("/site/app.js.gz")
+	if err != nil {
+		t.Fatalf("Open %q: %v", "/site/app.js.gz", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("read gzip output: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("decompressed content mismatch")
+	}
+}
+
+// TestRecursiveFS_AllFormats drives gzip, brotli and zstd in the same pass
+// (the fan-out ParseFormats("gzip,br,zstd") wires up) and decodes every
+// sibling, so a wiring mistake in either the brotli or zstd Encoder (wrong
+// extension, truncated stream, wrong Close ordering) fails the test instead
+// of passing silently.
+func TestRecursiveFS_AllFormats(t *testing.T) {
+	fs := memFS(t)
+	content := []byte(strings.Repeat("hello pre-compress world ", 200))
+	if err := fs.WriteFile("/site/app.js", content, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	encs, err := ParseFormats("gzip,br,zstd")
+	if err != nil {
+		t.Fatalf("ParseFormats: %v", err)
+	}
+	o := &Options{Encoders: encs}
+	summary, err := RecursiveFS(fs, "/site", time.Now(), 2, nil, o)
+	if err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+	if summary.Compressed != 1 {
+		t.Fatalf("Compressed = %d, want 1", summary.Compressed)
+	}
+
+	cases := []struct {
+		ext    string
+		decode func(io.Reader) (io.Reader, error)
+	}{
+		{".gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{".br", func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{".zst", func(r io.Reader) (io.Reader, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		}},
+	}
+	for _, c := range cases {
+		path := "/site/app.js" + c.ext
+		f, err := fs.Open(path)
+		if err != nil {
+			t.Fatalf("Open %q: %v", path, err)
+		}
+		r, err := c.decode(f)
+		if err != nil {
+			t.Fatalf("decode %q: %v", path, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %q: %v", path, err)
+		}
+		_ = f.Close()
+		if string(got) != string(content) {
+			t.Fatalf("%s decompressed content mismatch", c.ext)
+		}
+	}
+}
+
+func TestRecursiveFS_SkipMIME(t *testing.T) {
+	fs := memFS(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	if err := fs.WriteFile("/site/logo.png", png, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	o := &Options{
+		Encoders: []Encoder{gzipEncoder{}},
+		SkipMIME: []string{"image/*"},
+	}
+	summary, err := RecursiveFS(fs, "/site", time.Now(), 2, nil, o)
+	if err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+	if summary.SkippedMIME != 1 {
+		t.Fatalf("SkippedMIME = %d, want 1", summary.SkippedMIME)
+	}
+	if summary.Compressed != 0 {
+		t.Fatalf("Compressed = %d, want 0", summary.Compressed)
+	}
+	if _, err = fs.Stat("/site/logo.png.gz"); err == nil {
+		t.Fatalf("logo.png.gz should not have been written")
+	}
+}
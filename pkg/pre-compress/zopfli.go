@@ -0,0 +1,114 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/foobaz/go-zopfli/zopfli"
+	"github.com/klauspost/compress/gzip"
+)
+
+// zopfliEncoder replaces gzipEncoder's output with Zopfli's deflate
+// encoder, which typically shrinks gzipped JS/CSS/HTML by a further 3-8%
+// over gzip.BestCompression at roughly 100x the CPU cost. That tradeoff
+// only makes sense because pre-compress runs once at build time and the
+// output is served forever, so ApplyZopfli is opt-in via -zopfli.
+type zopfliEncoder struct{}
+
+func (zopfliEncoder) Ext() string    { return ".gz" }
+func (zopfliEncoder) BestLevel() int { return gzip.BestCompression }
+
+// NewWriter buffers every byte written (Zopfli compresses the whole input
+// at once, it cannot stream) behind a cheap gzip.BestCompression probe
+// writing into a throwaway buffer with the same size threshold as dst. If
+// the probe can't beat the threshold, the file isn't worth Zopfli's cost
+// either, so Close skips straight to errSizeThresholdExceeded instead of
+// spending 100x the CPU to learn the same thing.
+func (e zopfliEncoder) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	threshold := 0
+	if lw, ok := dst.(*limitedWriter); ok {
+		threshold = lw.n
+	}
+	probe, err := gzip.NewWriterLevel(
+		&limitedWriter{buf: &bytes.Buffer{}, n: threshold}, gzip.BestCompression,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &zopfliWriteCloser{dst: dst, probe: probe}, nil
+}
+
+type zopfliWriteCloser struct {
+	dst     io.Writer
+	probe   *gzip.Writer
+	raw     bytes.Buffer
+	aborted bool
+}
+
+func (z *zopfliWriteCloser) Write(p []byte) (int, error) {
+	if z.aborted {
+		return 0, errSizeThresholdExceeded
+	}
+	if _, err := z.probe.Write(p); err != nil {
+		if errors.Is(err, errSizeThresholdExceeded) {
+			z.aborted = true
+		}
+		return 0, err
+	}
+	z.raw.Write(p)
+	return len(p), nil
+}
+
+func (z *zopfliWriteCloser) Close() error {
+	if z.aborted {
+		return nil
+	}
+	if err := z.probe.Close(); err != nil {
+		if errors.Is(err, errSizeThresholdExceeded) {
+			// The probe only learns it overflowed once its trailer is
+			// flushed here, after Write already reported success, so the
+			// caller's fanOutWriter never got to mark this sink aborted.
+			// Surface the sentinel from Close instead so IfSmallerBuffer's
+			// closing loop skips this sink rather than writing an empty
+			// "compressed" output for a file Zopfli never actually ran on.
+			return errSizeThresholdExceeded
+		}
+		return err
+	}
+
+	opts := zopfli.DefaultOptions()
+	return zopfli.GzipCompress(&opts, z.raw.Bytes(), z.dst)
+}
+
+// ApplyZopfli swaps gzipEncoder for zopfliEncoder wherever it appears in
+// encs, leaving every other format untouched.
+func ApplyZopfli(encs []Encoder) []Encoder {
+	out := make([]Encoder, len(encs))
+	for i, enc := range encs {
+		if _, ok := enc.(gzipEncoder); ok {
+			out[i] = zopfliEncoder{}
+		} else {
+			out[i] = enc
+		}
+	}
+	return out
+}
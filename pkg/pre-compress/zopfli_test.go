@@ -0,0 +1,95 @@
+/*
+ * Pre-Compress
+ * Copyright (C) 2023 Jakob Ackermann <das7pad@outlook.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package precompress
+
+import (
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyZopfli_CompressesAndDecodes(t *testing.T) {
+	fs := memFS(t)
+	content := []byte(strings.Repeat("hello pre-compress world ", 200))
+	if err := fs.WriteFile("/site/app.js", content, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	encs, err := ParseFormats(DefaultFormats)
+	if err != nil {
+		t.Fatalf("ParseFormats: %v", err)
+	}
+	o := &Options{Encoders: ApplyZopfli(encs)}
+	summary, err := RecursiveFS(fs, "/site", time.Now(), 2, nil, o)
+	if err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+	if summary.Compressed != 1 {
+		t.Fatalf("Compressed = %d, want 1", summary.Compressed)
+	}
+
+	f, err := fs.Open("/site/app.js.gz")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("read zopfli output: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("decompressed content mismatch")
+	}
+}
+
+// TestApplyZopfli_AbortsOnThreshold exercises the probe: content that even
+// cheap gzip.BestCompression can't shrink below the source size must abort
+// before ever invoking Zopfli, and IfSmallerBuffer must end up not writing
+// a .gz sibling at all.
+func TestApplyZopfli_AbortsOnThreshold(t *testing.T) {
+	fs := memFS(t)
+	content := make([]byte, 256)
+	rand.New(rand.NewSource(1)).Read(content) //nolint:gosec // deterministic test fixture, not a secret
+	if err := fs.WriteFile("/site/blob.bin", content, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	encs, err := ParseFormats(DefaultFormats)
+	if err != nil {
+		t.Fatalf("ParseFormats: %v", err)
+	}
+	o := &Options{Encoders: ApplyZopfli(encs)}
+	summary, err := RecursiveFS(fs, "/site", time.Now(), 2, nil, o)
+	if err != nil {
+		t.Fatalf("RecursiveFS: %v", err)
+	}
+	if summary.Compressed != 0 {
+		t.Fatalf("Compressed = %d, want 0", summary.Compressed)
+	}
+	if _, err = fs.Stat("/site/blob.bin.gz"); err == nil {
+		t.Fatalf("blob.bin.gz should not have been written")
+	}
+}